@@ -0,0 +1,116 @@
+// checkpoint.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// checkpointFile is the resumable-extraction marker written every
+// -checkpoint-every items under outDir and read back on -resume. Because
+// gzip streams aren't seekable, resuming doesn't seek the compressed input
+// at all (outside of the advanced -resume-offset/-gzindex path) -- it
+// fast-decodes-and-discards in_network items up to ItemIndex before handing
+// anything to a worker. ItemIndex is only ever written after
+// runExtraction's checkpointBarrier confirms every worker has flushed, so
+// it never points past what's actually durable on disk. RowsPerCode is
+// diagnostic only -- a human-inspectable sanity check, not load-bearing.
+// WriterSizes *is* load-bearing for -resume: getWriter truncates each
+// per-code CSV back to its recorded size before appending, so rows written
+// (and about to be replayed) after this checkpoint don't end up duplicated.
+type checkpointFile struct {
+	InputSHA256 string           `json:"input_sha256"`
+	GzipOffset  int64            `json:"gzip_offset"` // bytes consumed off the decompressed stream so far; see openInNetworkStream
+	ItemIndex   int64            `json:"item_index"`  // ordinal of the next in_network item to (re)process
+	RowsPerCode map[string]int64 `json:"rows_per_code"`
+	WriterSizes map[string]int64 `json:"writer_sizes"` // per-code output file name -> exact size at this checkpoint; see getWriter
+}
+
+func checkpointPath(outDir string) string { return filepath.Join(outDir, ".mrfckpt.json") }
+
+// loadCheckpoint reads outDir's checkpoint, if any. A missing file isn't an
+// error: it just means there's nothing to resume from.
+func loadCheckpoint(outDir string) (*checkpointFile, error) {
+	b, err := os.ReadFile(checkpointPath(outDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpointFile
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// save writes cp to outDir atomically (temp file + rename) so a crash
+// mid-write never leaves a half-written checkpoint for a later -resume to
+// trust.
+func (cp *checkpointFile) save(outDir string) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	path := checkpointPath(outDir)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeCheckpoint snapshots progress to outDir's checkpoint file: itemIndex
+// and inputOffset (dec.InputOffset(), plus ec.resumeOffset if this run
+// itself started from a -resume-offset seek), and csvDir's current per-code
+// file sizes, are what -resume actually relies on; rowsByCode is only there
+// so a human inspecting the checkpoint can see roughly how far each code
+// got. inputHash is the caller's already-computed sha256File(ec.inPath) --
+// it's not cheap to redo on every checkpoint for a multi-GB input.
+func writeCheckpoint(ec extractionConfig, outDir, csvDir, inputHash string, itemIndex, inputOffset int64, rowsByCode *sync.Map) error {
+	cp := &checkpointFile{
+		InputSHA256: inputHash,
+		GzipOffset:  ec.resumeOffset + inputOffset,
+		ItemIndex:   itemIndex,
+		RowsPerCode: map[string]int64{},
+		WriterSizes: map[string]int64{},
+	}
+	rowsByCode.Range(func(k, v any) bool {
+		cp.RowsPerCode[k.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+	if !ec.noLocal {
+		if entries, err := os.ReadDir(csvDir); err == nil {
+			for _, e := range entries {
+				if e.IsDir() { continue }
+				if info, err := e.Info(); err == nil {
+					cp.WriterSizes[e.Name()] = info.Size()
+				}
+			}
+		}
+	}
+	return cp.save(outDir)
+}
+
+// sha256File hashes the (possibly still-compressed, possibly multi-GB)
+// input file once so -resume can refuse a checkpoint written against a
+// different -input rather than silently replaying the wrong item range.
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,85 @@
+// codes.go
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// codeKey identifies one billing code uniquely across code systems: CPT
+// 99213 and MS-DRG 99213 are unrelated codes and must never share a writer
+// or an output file.
+type codeKey struct {
+	Type string
+	Code string
+}
+
+// join is codeKey's hash/map-diagnostic form -- used for shardFor and for
+// checkpoint.go's RowsPerCode keys, neither of which care about the struct
+// itself, just a stable string.
+func (k codeKey) join() string { return k.Type + "|" + k.Code }
+
+// normalizeCodeType upper-cases and trims a billing_code_type so allowlist
+// entries (from -codes, -codes-file, or an in_network item) all compare the
+// same way regardless of casing or incidental whitespace. Any CPT variant
+// (CPT, CPT-4, CPT4, ...) collapses to the bare "CPT" the -codes shortcut
+// already tags its codes with -- BCBS MRFs use these interchangeably, and
+// the baseline's strings.HasPrefix(bct, "CPT") matched all of them, so
+// -codes needs the same reach here or CPT-4 items silently stop matching.
+func normalizeCodeType(s string) string {
+	t := strings.ToUpper(strings.TrimSpace(s))
+	if strings.HasPrefix(t, "CPT") { return "CPT" }
+	return t
+}
+
+// parseCodesFlag builds the -codes shortcut allowlist: a comma/space/tab
+// separated list of bare codes, all assumed billing_code_type CPT, matching
+// the flag's behavior from before -codes-file existed.
+func parseCodesFlag(codeStr string) map[codeKey]struct{} {
+	allowed := make(map[codeKey]struct{})
+	for _, tok := range strings.FieldsFunc(codeStr, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		if t := strings.TrimSpace(tok); t != "" {
+			allowed[codeKey{Type: "CPT", Code: t}] = struct{}{}
+		}
+	}
+	return allowed
+}
+
+// parseCodesFile reads a CSV (or, for a .tsv path, tab-separated) file of
+// "billing_code_type,billing_code" pairs into an allowlist, one pair per
+// row. This is what unlocks HCPCS, MS-DRG, APR-DRG, ICD, LOCAL, CDT, and any
+// other code system BCBS MRFs use, beyond the CPT-only -codes shortcut.
+func parseCodesFile(path string) (map[codeKey]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	r := csv.NewReader(bufio.NewReader(f))
+	r.FieldsPerRecord = -1
+	if strings.HasSuffix(strings.ToLower(path), ".tsv") {
+		r.Comma = '\t'
+	}
+
+	allowed := make(map[codeKey]struct{})
+	lineNo := 0
+	for {
+		rec, err := r.Read()
+		if err == io.EOF { break }
+		if err != nil { return nil, fmt.Errorf("%s: %w", path, err) }
+		lineNo++
+		if len(rec) < 2 { continue }
+
+		typ := normalizeCodeType(rec[0])
+		code := strings.TrimSpace(rec[1])
+		if typ == "" || code == "" { continue }
+		if lineNo == 1 && (typ == "BILLING_CODE_TYPE" || typ == "TYPE") {
+			continue // tolerate a header row without hard-coding its exact spelling
+		}
+		allowed[codeKey{Type: typ, Code: code}] = struct{}{}
+	}
+	return allowed, nil
+}
@@ -2,22 +2,18 @@
 package main
 
 import (
-	"bufio"
-	"compress/gzip"
 	"context"
-	"encoding/csv"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	s3 "github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
@@ -28,9 +24,9 @@ type Item struct {
 	NegotiatedRates        []Rate `json:"negotiated_rates"`
 }
 type Rate struct {
-	ProviderGroups     []ProviderGroup   `json:"provider_groups"`
-	ProviderReferences []json.RawMessage `json:"provider_references"`
-	NegotiatedPrices   []Price           `json:"negotiated_prices"`
+	ProviderGroups     []ProviderGroup `json:"provider_groups"`
+	ProviderReferences []int64         `json:"provider_references"`
+	NegotiatedPrices   []Price         `json:"negotiated_prices"`
 }
 type ProviderGroup struct {
 	TIN *struct {
@@ -48,18 +44,115 @@ type Price struct {
 	BillingClass        string   `json:"billing_class"`
 }
 
+// r2Client bundles what extractOne needs to upload its outputs; built once
+// in main() and shared across every file processed, including every plan
+// visited in -toc mode. uploader is only exercised directly by workerState
+// under -no-local; everything else still goes through uploadFile.
+type r2Client struct {
+	s3       *s3.Client
+	bucket   string
+	uploader *manager.Uploader
+}
+
+func (c r2Client) uploadFile(ctx context.Context, localPath, key, contentType string) error {
+	f, err := os.Open(localPath)
+	if err != nil { return err }
+	defer f.Close()
+	_, err = c.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &c.bucket,
+		Key:         &key,
+		Body:        f,
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+// extractionConfig is everything a single in_network-rates.json.gz pass
+// needs. main() builds one of these directly from flags for plain -input
+// runs; -toc mode builds one per matched in_network_files entry.
+type extractionConfig struct {
+	inPath             string
+	outDir             string
+	allowed            map[codeKey]struct{}
+	usePigz            bool
+	pigzThreads        int
+	progressEvery      int
+	prefix             string
+	format             string // "csv" (default) or "parquet"
+	parquetRowGroup    int
+	parquetCompression string
+	workers            int // number of sharded per-code worker goroutines
+	noLocal            bool   // stream per-code output straight to R2 instead of writing to outDir/csv first
+	resume             bool   // resume from outDir's checkpoint, skipping already-processed items
+	checkpointEvery    int    // write a checkpoint every N in_network items; 0 disables
+	resumeOffset       int64  // uncompressed byte offset to fast-forward to via gzindex
+	gzindex            string // path to a gztool-style .gzi index for inPath, required by resumeOffset
+
+	// resumeWriterSizes is populated internally by runExtraction from the
+	// loaded checkpoint's WriterSizes (ec.resume only); it is never set by
+	// main's flag parsing. getWriter uses it to truncate each per-code CSV
+	// back to its last durably-checkpointed size before appending, so rows
+	// written (and replayed) after that checkpoint aren't duplicated.
+	resumeWriterSizes map[string]int64
+}
+
 func main() {
 	inPath := flag.String("input", "", "Path to in-network-rates.json.gz")
 	outDir := flag.String("out", "/tmp/out", "Output directory")
-	codeStr := flag.String("codes", "", "Comma/space-separated CPT codes")
+	codeStr := flag.String("codes", "", "Comma/space-separated CPT codes (shortcut for -codes-file, billing_code_type=CPT)")
+	codesFile := flag.String("codes-file", "", "Path to a CSV/TSV of billing_code_type,billing_code pairs (HCPCS, MS-DRG, APR-DRG, ICD, LOCAL, CDT, ...)")
 	usePigz := flag.Bool("pigz", false, "Use pigz -dc for decompression")
 	pigzThreads := flag.Int("pigz-threads", 0, "Threads for pigz (-p N)")
 	progressEvery := flag.Int("progress", 750000, "Row progress cadence")
 	prefix := flag.String("prefix", "", "R2 key prefix (e.g., BCBS/August-25-PPO-SJ)")
+	tocPath := flag.String("toc", "", "Table of Contents URL or path; when set, -input is ignored and every matching in_network file is extracted")
+	tocPlanName := flag.String("toc-plan-name", "", "Only process reporting_structure entries whose reporting_plans[].plan_name contains this substring")
+	tocPlanEIN := flag.String("toc-plan-ein", "", "Only process reporting_structure entries whose reporting_plans[].plan_id equals this EIN")
+	format := flag.String("format", "csv", "Output format: csv (default) or parquet")
+	parquetRowGroup := flag.Int("parquet-row-group", 250000, "Rows per parquet row group (-format parquet only)")
+	parquetCompression := flag.String("parquet-compression", "snappy", "Parquet compression codec: snappy or zstd (-format parquet only)")
+	workers := flag.Int("workers", 4, "Number of parallel per-code worker goroutines; each owns a disjoint subset of -codes")
+	noLocal := flag.Bool("no-local", false, "Stream per-code output directly to R2 via multipart upload instead of writing to -out/csv first")
+	partSizeMiB := flag.Int64("part-size", 16, "Multipart upload part size in MiB (-no-local only)")
+	uploadConcurrency := flag.Int("upload-concurrency", 5, "Concurrent part uploads per file (-no-local only)")
+	resume := flag.Bool("resume", false, "Resume from <outDir>/.mrfckpt.json, skipping in_network items already processed in a prior run")
+	checkpointEvery := flag.Int("checkpoint-every", 500000, "Write a resume checkpoint every N in_network items; 0 disables checkpointing")
+	resumeOffset := flag.Int64("resume-offset", 0, "Uncompressed byte offset to fast-forward to via -gzindex before decoding (advanced; pairs with a prior checkpoint's gzip_offset)")
+	gzindex := flag.String("gzindex", "", "Path to a gztool-style .gzi index for -input; required to use -resume-offset")
 	flag.Parse()
 
-	if *inPath == "" || *codeStr == "" {
+	if *format != "csv" && *format != "parquet" {
+		fmt.Fprintf(os.Stderr, "Unknown -format %q (want csv or parquet)\n", *format)
+		os.Exit(2)
+	}
+	if *noLocal && *format != "csv" {
+		fmt.Fprintln(os.Stderr, "-no-local only supports -format csv; parquet needs a local, seekable file")
+		os.Exit(2)
+	}
+	if *resume && *noLocal {
+		fmt.Fprintln(os.Stderr, "-resume is incompatible with -no-local: a streamed multipart upload can't be resumed mid-file")
+		os.Exit(2)
+	}
+	if *resume && *format != "csv" {
+		fmt.Fprintln(os.Stderr, "-resume only supports -format csv; parquet row groups aren't append-safe")
+		os.Exit(2)
+	}
+	if *resumeOffset > 0 && *gzindex == "" {
+		fmt.Fprintln(os.Stderr, "-resume-offset requires -gzindex")
+		os.Exit(2)
+	}
+	if *gzindex != "" && !*usePigz {
+		fmt.Fprintln(os.Stderr, "-gzindex requires -pigz")
+		os.Exit(2)
+	}
+
+	if *tocPath == "" && *inPath == "" {
 		fmt.Fprintln(os.Stderr, "Usage: -input <file.json.gz> -out <dir> -codes \"27130,...\" -prefix <folder> [options]")
+		fmt.Fprintln(os.Stderr, "   or: -toc <url|path> -out <dir> -codes \"27130,...\" -prefix <folder> [-toc-plan-name ... -toc-plan-ein ...]")
+		os.Exit(2)
+	}
+	if *codeStr == "" && *codesFile == "" {
+		fmt.Fprintln(os.Stderr, "No codes given: use -codes (CPT shortcut) or -codes-file (any code system)")
 		os.Exit(2)
 	}
 	account := os.Getenv("R2_ACCOUNT_ID")
@@ -72,153 +165,33 @@ func main() {
 	}
 	endpoint := "https://" + account + ".r2.cloudflarestorage.com"
 
-	// allowlist
-	allowed := make(map[string]struct{})
-	for _, tok := range strings.FieldsFunc(*codeStr, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
-		if t := strings.TrimSpace(tok); t != "" {
-			allowed[t] = struct{}{}
+	// allowlist: -codes-file (any code system) merged with -codes (the
+	// CPT-only shortcut), so callers can combine e.g. an HCPCS/MS-DRG file
+	// with a quick ad-hoc CPT list on the command line.
+	allowed := make(map[codeKey]struct{})
+	for k := range parseCodesFlag(*codeStr) {
+		allowed[k] = struct{}{}
+	}
+	if *codesFile != "" {
+		fileAllowed, err := parseCodesFile(*codesFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Reading -codes-file: %v\n", err)
+			os.Exit(2)
+		}
+		for k := range fileAllowed {
+			allowed[k] = struct{}{}
 		}
 	}
 	if len(allowed) == 0 {
-		fmt.Fprintln(os.Stderr, "No valid codes parsed from -codes")
+		fmt.Fprintln(os.Stderr, "No valid codes parsed from -codes/-codes-file")
 		os.Exit(2)
 	}
 
-	// outputs
-	csvDir := filepath.Join(*outDir, "csv")
-	if err := os.MkdirAll(csvDir, 0o755); err != nil { panic(err) }
-	unresPath := filepath.Join(*outDir, "unresolved_provider_references.csv")
-	unresF, err := os.Create(unresPath); if err != nil { panic(err) }
-	unresW := csv.NewWriter(bufio.NewWriterSize(unresF, 1<<20))
-	_ = unresW.Write([]string{"billing_code", "ref_id"})
-	defer func() { unresW.Flush(); unresF.Close() }()
-
-	// one CSV writer per code
-	type writerPack struct{ f *os.File; w *csv.Writer }
-	writers := map[string]*writerPack{}
-	getWriter := func(code string) *writerPack {
-		if wp, ok := writers[code]; ok { return wp }
-		path := filepath.Join(csvDir, fmt.Sprintf("in_network_%s.csv", code))
-		f, err := os.Create(path); if err != nil { panic(err) }
-		bw := bufio.NewWriterSize(f, 1<<20)
-		w := csv.NewWriter(bw)
-		_ = w.Write([]string{
-			"npi","tin_type","tin_value",
-			"negotiated_rate","expiration_date","service_code",
-			"billing_code","billing_code_type","negotiation_arrangement",
-			"negotiated_type","billing_class","billing_code_modifier",
-		})
-		wp := &writerPack{f: f, w: w}
-		writers[code] = wp
-		return wp
-	}
-
-	// input stream
-	var r io.ReadCloser
-	if *usePigz {
-		args := []string{"-dc"}
-		if *pigzThreads > 0 { args = []string{"-p", fmt.Sprint(*pigzThreads), "-dc"} }
-		cmd := exec.Command("pigz", append(args, *inPath)...)
-		stdout, err := cmd.StdoutPipe(); if err != nil { panic(err) }
-		if err := cmd.Start(); err != nil { panic(err) }
-		r = io.NopCloser(stdout)
-		defer func() { stdout.Close(); _ = cmd.Wait() }()
-	} else {
-		f, err := os.Open(*inPath); if err != nil { panic(err) }
-		gr, err := gzip.NewReader(f); if err != nil { panic(err) }
-		r = gr
-		defer func() { gr.Close(); f.Close() }()
-	}
-
-	dec := json.NewDecoder(bufio.NewReaderSize(r, 1<<20))
-	dec.UseNumber()
-
-	// expect root object { ... "in_network": [ ... ] ... }
-	expectDelim(dec, '{')
-	// find "in_network"
-	found := false
-	for dec.More() {
-		k := expectString(dec) // key
-		if k == "in_network" {
-			expectDelim(dec, '[')
-			found = true
-			break
-		}
-		skipValue(dec)
-	}
-	if !found { panic("no in_network field found") }
-
-	var (
-		seenItems, keptItems, outRows int64
-		skippedRefRates, skippedRefIDs int64
-	)
-	for dec.More() {
-		var it Item
-		if err := dec.Decode(&it); err != nil { panic(err) }
-		seenItems++
-
-		bct := strings.ToUpper(strings.TrimSpace(it.BillingCodeType))
-		if !strings.HasPrefix(bct, "CPT") { continue }
-		bc := strings.TrimSpace(it.BillingCode)
-		if bc == "" { continue }
-		if _, ok := allowed[bc]; !ok { continue }
-		keptItems++
-
-		na := anyToString(it.NegotiationArrangement)
-
-		for _, rate := range it.NegotiatedRates {
-			if len(rate.ProviderReferences) > 0 {
-				skippedRefRates++
-				for range rate.ProviderReferences {
-					_ = unresW.Write([]string{bc, "ref_id"})
-					skippedRefIDs++
-				}
-			}
-			if len(rate.ProviderGroups) == 0 || len(rate.NegotiatedPrices) == 0 {
-				continue
-			}
-			wp := getWriter(bc)
-			for _, pg := range rate.ProviderGroups {
-				tinType, tinVal := "", ""
-				if pg.TIN != nil { tinType = pg.TIN.Type; tinVal = pg.TIN.Value }
-				npis := normalizeNPIs(pg.NPI)
-				if len(npis) == 0 { continue }
-
-				for _, p := range rate.NegotiatedPrices {
-					scodes := strings.Join(nilIfNil(p.ServiceCode), "|")
-					mods := strings.Join(nilIfNil(p.BillingCodeModifier), "|")
-					ntype := p.NegotiatedType
-					bclass := p.BillingClass
-					rateStr := anyToString(p.NegotiatedRate)
-					exp := p.ExpirationDate
-
-					for _, npi := range npis {
-						_ = wp.w.Write([]string{
-							npi, tinType, tinVal,
-							rateStr, exp, scodes,
-							bc, bct, na,
-							ntype, bclass, mods,
-						})
-						outRows++
-						if *progressEvery > 0 && (outRows%int64(*progressEvery) == 0) {
-							fmt.Printf("[progress] CPT items: %d  rows: %d\n", keptItems, outRows)
-						}
-					}
-				}
-			}
-		}
-	}
-	expectDelim(dec, ']') // end of in_network
-
-	// flush/close writers
-	for _, wp := range writers { wp.w.Flush(); _ = wp.f.Close() }
-	unresW.Flush(); _ = unresF.Close()
-
-	// ---- R2 upload ----
 	ctx := context.Background()
 	cfg, err := config.LoadDefaultConfig(ctx,
 		config.WithRegion("auto"),
 		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(ak, sk, "")),
+		config.WithRetryer(func() aws.Retryer { return newUploadRetryer() }),
 		config.WithEndpointResolverWithOptions(aws.EndpointResolverWithOptionsFunc(
 			func(service, region string, _ ...interface{}) (aws.Endpoint, error) {
 				if service == s3.ServiceID {
@@ -232,40 +205,122 @@ func main() {
 		)),
 	)
 	if err != nil { panic(err) }
-	s3c := s3.NewFromConfig(cfg, func(o *s3.Options) { o.UsePathStyle = false })
+	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) { o.UsePathStyle = false })
+	uploader := manager.NewUploader(s3Client, func(u *manager.Uploader) {
+		u.PartSize = *partSizeMiB * 1024 * 1024
+		u.Concurrency = *uploadConcurrency
+	})
+	r2 := r2Client{s3: s3Client, bucket: bucket, uploader: uploader}
+
+	if *tocPath != "" {
+		if err := runTOC(ctx, tocConfig{
+			tocPath:       *tocPath,
+			planNameMatch: *tocPlanName,
+			planEIN:       *tocPlanEIN,
+			outDir:        *outDir,
+			allowed:       allowed,
+			usePigz:            *usePigz,
+			pigzThreads:        *pigzThreads,
+			progressEvery:      *progressEvery,
+			prefix:             *prefix,
+			format:             *format,
+			parquetRowGroup:    *parquetRowGroup,
+			parquetCompression: *parquetCompression,
+			workers:            *workers,
+			noLocal:            *noLocal,
+			resume:             *resume,
+			checkpointEvery:    *checkpointEvery,
+			resumeOffset:       *resumeOffset,
+			gzindex:            *gzindex,
+		}, r2); err != nil {
+			panic(err)
+		}
+		return
+	}
 
-	uploadFile := func(localPath, key string, contentType string) error {
-		f, err := os.Open(localPath); if err != nil { return err }
-		defer f.Close()
-		_, err = s3c.PutObject(ctx, &s3.PutObjectInput{
-			Bucket:      &bucket,
-			Key:         &key,
-			Body:        f,
-			ContentType: aws.String(contentType),
-		})
-		return err
+	if _, err := extractOne(ctx, extractionConfig{
+		inPath:             *inPath,
+		outDir:             *outDir,
+		allowed:            allowed,
+		usePigz:            *usePigz,
+		pigzThreads:        *pigzThreads,
+		progressEvery:      *progressEvery,
+		prefix:             *prefix,
+		format:             *format,
+		parquetRowGroup:    *parquetRowGroup,
+		parquetCompression: *parquetCompression,
+		workers:            *workers,
+		noLocal:            *noLocal,
+		resume:             *resume,
+		checkpointEvery:    *checkpointEvery,
+		resumeOffset:       *resumeOffset,
+		gzindex:            *gzindex,
+	}, r2); err != nil {
+		panic(err)
 	}
+}
 
-	// CSVs
-	entries, _ := os.ReadDir(csvDir)
-	for _, e := range entries {
-		if e.IsDir() { continue }
-		lp := filepath.Join(csvDir, e.Name())
-		key := filepath.ToSlash(filepath.Join(*prefix, e.Name()))
-		fmt.Println("Uploading:", "s3://"+bucket+"/"+key)
-		if err := uploadFile(lp, key, "text/csv"); err != nil { panic(err) }
+// extractionSummary reports what one extractOne call did; -toc mode
+// aggregates these across every plan/file it visits.
+type extractionSummary struct {
+	SeenItems, KeptItems, OutRows  int64
+	SkippedRefRates, SkippedRefIDs int64
+}
+
+// extractOne runs the full pipeline for a single in_network-rates.json.gz:
+// resolve provider_references, stream in_network into per-code CSVs, then
+// upload everything under cfg.prefix. This is the shared core used by both
+// plain -input runs and every file discovered via -toc. Under ec.noLocal the
+// csvDir tree is never created; each worker's writer streams straight to R2
+// as it goes, so there is nothing left for the loop below to upload. ec.outDir
+// itself is always created, noLocal or not: newWorkerState writes
+// unresolved_provider_references.csv there, and -resume/-checkpoint-every
+// write their checkpoint there too.
+func extractOne(ctx context.Context, ec extractionConfig, r2 r2Client) (*extractionSummary, error) {
+	if err := os.MkdirAll(ec.outDir, 0o755); err != nil { return nil, err }
+	csvDir := filepath.Join(ec.outDir, "csv")
+	if !ec.noLocal {
+		if err := os.MkdirAll(csvDir, 0o755); err != nil { return nil, err }
+	}
+
+	// first pass: resolve provider_references (inline + external "location" files)
+	// into an in-memory index before we touch in_network at all.
+	refIndex, err := buildProviderRefIndex(ec.inPath, ec.usePigz, ec.pigzThreads)
+	if err != nil { return nil, err }
+
+	// second pass: stream in_network, sharded across ec.workers goroutines
+	// that each own a disjoint set of billing codes (and therefore writers).
+	summary, unresPaths, err := runExtraction(ctx, ec, r2, refIndex, csvDir, ec.outDir)
+	if err != nil { return nil, err }
+
+	// ---- R2 upload ----
+	if !ec.noLocal {
+		contentType := outputContentType(ec.format)
+		entries, _ := os.ReadDir(csvDir)
+		for _, e := range entries {
+			if e.IsDir() { continue }
+			lp := filepath.Join(csvDir, e.Name())
+			key := filepath.ToSlash(filepath.Join(ec.prefix, e.Name()))
+			fmt.Println("Uploading:", "s3://"+r2.bucket+"/"+key)
+			if err := r2.uploadFile(ctx, lp, key, contentType); err != nil { return nil, err }
+		}
 	}
 
-	// unresolved (only if non-empty > header)
-	if st, err := os.Stat(unresPath); err == nil && st.Size() > 20 {
-		key := filepath.ToSlash(filepath.Join(*prefix, "unresolved_provider_references.csv"))
-		fmt.Println("Uploading:", "s3://"+bucket+"/"+key)
-		if err := uploadFile(unresPath, key, "text/csv"); err != nil { panic(err) }
+	// unresolved refs, one file per worker (only upload if it has rows beyond
+	// its header -- unresolvedRefHeaderLine is that header's exact size)
+	for _, unresPath := range unresPaths {
+		st, err := os.Stat(unresPath)
+		if err != nil || st.Size() <= int64(len(unresolvedRefHeaderLine)) { continue }
+		key := filepath.ToSlash(filepath.Join(ec.prefix, filepath.Base(unresPath)))
+		fmt.Println("Uploading:", "s3://"+r2.bucket+"/"+key)
+		if err := r2.uploadFile(ctx, unresPath, key, "text/csv"); err != nil { return nil, err }
 	}
 
-	fmt.Println("----- SUMMARY -----")
-	// (Optional: you can also print counters you tracked)
+	fmt.Printf("----- SUMMARY (%s) -----\n", ec.prefix)
+	fmt.Printf("items seen=%d kept=%d rows=%d refRates=%d unresolvedRefs=%d\n",
+		summary.SeenItems, summary.KeptItems, summary.OutRows, summary.SkippedRefRates, summary.SkippedRefIDs)
 	fmt.Println("âœ… Done (local files written and uploaded to R2).")
+	return summary, nil
 }
 
 // ---- helpers ----
@@ -287,7 +342,6 @@ func anyToString(v any) string {
 		return string(b)
 	}
 }
-func nilIfNil(s []string) []string { if s == nil { return []string{} }; return s }
 func normalizeNPIs(v any) []string {
 	switch a := v.(type) {
 	case nil:
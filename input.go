@@ -0,0 +1,120 @@
+// input.go
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// openInput opens path as a decompressed byte stream, either by shelling
+// out to pigz (for parallel decompression on large files) or via the
+// standard library gzip reader. The returned closer tears down whatever
+// process/file handles were opened and must be deferred by the caller.
+// Every streaming pass over the input (provider_references, in_network)
+// goes through this so they all get the same pigz/threads behavior.
+func openInput(path string, usePigz bool, pigzThreads int) (io.ReadCloser, func(), error) {
+	if usePigz {
+		args := []string{"-dc"}
+		if pigzThreads > 0 {
+			args = []string{"-p", fmt.Sprint(pigzThreads), "-dc"}
+		}
+		cmd := exec.Command("pigz", append(args, path)...)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, nil, err
+		}
+		r := io.NopCloser(stdout)
+		return r, func() { stdout.Close(); _ = cmd.Wait() }, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return gr, func() { gr.Close(); f.Close() }, nil
+}
+
+// openInNetworkStream opens ec.inPath and returns a json.Decoder positioned
+// right after the opening '[' of the top-level in_network array. The
+// decoder's own dec.InputOffset() doubles as the checkpoint's GzipOffset --
+// exact, since it tracks the decoder's logical position rather than
+// however far ahead any bufio read-ahead has gone. The normal path scans
+// past provider_references from byte 0 to find that '['; openInNetworkStreamAt
+// is the -resume-offset shortcut.
+func openInNetworkStream(ec extractionConfig) (*json.Decoder, func(), error) {
+	if ec.resumeOffset > 0 && ec.gzindex != "" {
+		return openInNetworkStreamAt(ec)
+	}
+
+	r, closeInput, err := openInput(ec.inPath, ec.usePigz, ec.pigzThreads)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec := json.NewDecoder(bufio.NewReaderSize(r, 1<<20))
+	dec.UseNumber()
+	expectDelim(dec, '{')
+	found := false
+	for dec.More() {
+		k := expectString(dec)
+		if k == "in_network" {
+			expectDelim(dec, '[')
+			found = true
+			break
+		}
+		skipValue(dec)
+	}
+	if !found {
+		closeInput()
+		return nil, nil, fmt.Errorf("no in_network field found in %s", ec.inPath)
+	}
+	return dec, closeInput, nil
+}
+
+// openInNetworkStreamAt uses a gztool-style .gzi index (ec.gzindex) to seek
+// gztool's decompression straight to ec.resumeOffset -- the uncompressed
+// byte position recorded by a prior checkpoint's GzipOffset -- instead of
+// re-decompressing every byte before it. That offset is dec.InputOffset()
+// from the run that wrote it, taken after dec.More(), which lands just past a
+// decoded item's closing brace and any whitespace after it: the resumed byte stream therefore starts with either
+// ",<next item>,...],}" (there was a next item) or "],}" (it was the last
+// one), never with the next item's value directly. A leading "," has to be
+// peeled off before splicing in the synthetic "[", or the decoder sees the
+// invalid "[,{...}" instead of "[{...}".
+func openInNetworkStreamAt(ec extractionConfig) (*json.Decoder, func(), error) {
+	cmd := exec.Command("gztool", "-I", ec.gzindex, "-b", strconv.FormatInt(ec.resumeOffset, 10), ec.inPath)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReaderSize(stdout, 1<<20)
+	if b, err := br.Peek(1); err == nil && b[0] == ',' {
+		_, _ = br.Discard(1)
+	}
+
+	r := io.MultiReader(strings.NewReader("["), br)
+	dec := json.NewDecoder(bufio.NewReaderSize(r, 1<<20))
+	dec.UseNumber()
+	expectDelim(dec, '[')
+
+	closeFn := func() { stdout.Close(); _ = cmd.Wait() }
+	return dec, closeFn, nil
+}
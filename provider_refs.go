@@ -0,0 +1,149 @@
+// provider_refs.go
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// providerRefEntry mirrors one element of the top-level "provider_references"
+// array. CMS allows two shapes for an entry: an inline group list keyed by
+// "provider_group_id", or a pointer to an external file keyed by
+// "provider_reference_id" + "location".
+type providerRefEntry struct {
+	ProviderGroupID     *int64          `json:"provider_group_id"`
+	ProviderReferenceID *int64          `json:"provider_reference_id"`
+	ProviderGroups      []ProviderGroup `json:"provider_groups"`
+	Location            string          `json:"location"`
+}
+
+func (e providerRefEntry) id() (int64, bool) {
+	if e.ProviderGroupID != nil {
+		return *e.ProviderGroupID, true
+	}
+	if e.ProviderReferenceID != nil {
+		return *e.ProviderReferenceID, true
+	}
+	return 0, false
+}
+
+// buildProviderRefIndex runs a first pass over the top-level
+// "provider_references" array and returns a map from ref_id (as a string,
+// matching the ints found in negotiated_rates[].provider_references) to the
+// resolved provider groups. The array itself is decoded one entry at a
+// time; an entry that points at an external file via "location" is fetched
+// by fetchRemoteProviderGroups, which decodes that whole file in one go
+// rather than streaming it.
+func buildProviderRefIndex(inPath string, usePigz bool, pigzThreads int) (map[string][]ProviderGroup, error) {
+	r, closeFn, err := openInput(inPath, usePigz, pigzThreads)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFn()
+
+	dec := json.NewDecoder(bufio.NewReaderSize(r, 1<<20))
+	dec.UseNumber()
+
+	expectDelim(dec, '{')
+	found := false
+	for dec.More() {
+		k := expectString(dec)
+		if k == "provider_references" {
+			expectDelim(dec, '[')
+			found = true
+			break
+		}
+		skipValue(dec)
+	}
+	index := make(map[string][]ProviderGroup)
+	if !found {
+		return index, nil
+	}
+
+	var entries, remote int
+	for dec.More() {
+		var e providerRefEntry
+		if err := dec.Decode(&e); err != nil {
+			return nil, fmt.Errorf("decoding provider_references[%d]: %w", entries, err)
+		}
+		entries++
+		id, ok := e.id()
+		if !ok {
+			continue
+		}
+		key := strconv.FormatInt(id, 10)
+		if e.Location != "" {
+			groups, err := fetchRemoteProviderGroups(e.Location)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[provider_references] skipping ref_id %s, location fetch failed: %v\n", key, err)
+				continue
+			}
+			index[key] = groups
+			remote++
+			continue
+		}
+		index[key] = e.ProviderGroups
+	}
+	fmt.Printf("[provider_references] indexed %d refs (%d remote) from %s\n", entries, remote, inPath)
+	return index, nil
+}
+
+// fetchRemoteProviderGroups fetches a single provider_reference "location"
+// file and decodes it whole into payload.ProviderGroups -- unlike the main
+// in_network pass, there's no per-item streaming here: the caller needs the
+// complete slice to store in its ref_id index anyway, and these external
+// files are one plan's provider groups, not a multi-GB rates file, so the
+// memory cost of a full decode is proportionate. The file is a bare JSON
+// object of the form {"provider_group_id": N, "provider_groups": [...]},
+// optionally gzip compressed regardless of what the URL path or
+// Content-Encoding claims.
+func fetchRemoteProviderGroups(location string) ([]ProviderGroup, error) {
+	client := &http.Client{Timeout: 2 * time.Minute}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: status %s", location, resp.Status)
+	}
+
+	body := bufio.NewReader(resp.Body)
+	var r io.Reader = body
+	if isGzip(body) {
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("gzip %s: %w", location, err)
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	var payload struct {
+		ProviderGroups []ProviderGroup `json:"provider_groups"`
+	}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&payload); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", location, err)
+	}
+	return payload.ProviderGroups, nil
+}
+
+// isGzip peeks at the stream's magic bytes without consuming them, so
+// callers can transparently handle remote files regardless of whether the
+// server actually set Content-Encoding: gzip.
+func isGzip(r *bufio.Reader) bool {
+	head, err := r.Peek(2)
+	if err != nil {
+		return false
+	}
+	return head[0] == 0x1f && head[1] == 0x8b
+}
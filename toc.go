@@ -0,0 +1,216 @@
+// toc.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// tocDocument mirrors the CMS machine-readable Table of Contents shape:
+// reporting_structure[].reporting_plans[] identifies the plan(s) a group of
+// files belongs to, and reporting_structure[].in_network_files[] lists the
+// actual in-network-rates files for that group.
+type tocDocument struct {
+	ReportingStructure []tocReportingStructure `json:"reporting_structure"`
+}
+type tocReportingStructure struct {
+	ReportingPlans []tocReportingPlan `json:"reporting_plans"`
+	InNetworkFiles []tocFileRef       `json:"in_network_files"`
+}
+type tocReportingPlan struct {
+	PlanName   string `json:"plan_name"`
+	PlanIDType string `json:"plan_id_type"`
+	PlanID     string `json:"plan_id"`
+}
+type tocFileRef struct {
+	Description string `json:"description"`
+	Location    string `json:"location"`
+}
+
+// tocConfig carries the -toc flags plus everything extractOne needs to run
+// against each discovered in_network file.
+type tocConfig struct {
+	tocPath            string
+	planNameMatch      string
+	planEIN            string
+	outDir             string
+	allowed            map[codeKey]struct{}
+	usePigz            bool
+	pigzThreads        int
+	progressEvery      int
+	prefix             string
+	format             string
+	parquetRowGroup    int
+	parquetCompression string
+	workers            int
+	noLocal            bool
+	resume             bool
+	checkpointEvery    int
+	resumeOffset       int64
+	gzindex            string
+}
+
+var planSlugRe = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+func planSlug(name string) string {
+	s := planSlugRe.ReplaceAllString(strings.TrimSpace(name), "_")
+	s = strings.Trim(s, "_")
+	if s == "" { return "plan" }
+	return s
+}
+
+// loadTOC reads a Table of Contents document from either an http(s) URL or
+// a local path. Unlike the main extraction path, this is a plain
+// json.Decoder.Decode of the whole document into tocDocument: ToC files are
+// KB-to-low-MB (they list files, not rates), and runTOC needs random access
+// across reporting_structure to match plan filters before picking which
+// in_network_files to download, so there's no streaming win here worth the
+// complexity.
+func loadTOC(pathOrURL string) (*tocDocument, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(pathOrURL, "http://") || strings.HasPrefix(pathOrURL, "https://") {
+		resp, err := http.Get(pathOrURL)
+		if err != nil { return nil, err }
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: status %s", pathOrURL, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(pathOrURL)
+		if err != nil { return nil, err }
+		r = f
+	}
+	defer r.Close()
+
+	var doc tocDocument
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decoding toc %s: %w", pathOrURL, err)
+	}
+	return &doc, nil
+}
+
+// matchesPlanFilters reports whether any reporting_plans entry in rs
+// satisfies the requested plan name substring / EIN filters. Empty filters
+// always match, so -toc with no -toc-plan-* flags processes every file.
+func matchesPlanFilters(rs tocReportingStructure, nameMatch, ein string) (tocReportingPlan, bool) {
+	for _, p := range rs.ReportingPlans {
+		if nameMatch != "" && !strings.Contains(strings.ToLower(p.PlanName), strings.ToLower(nameMatch)) {
+			continue
+		}
+		if ein != "" && p.PlanID != ein {
+			continue
+		}
+		return p, true
+	}
+	return tocReportingPlan{}, false
+}
+
+// runTOC discovers in_network files via the payer's Table of Contents and
+// runs extractOne against each one in turn, namespacing every plan's
+// output under <prefix>/<plan_name>/ so CSVs from different plans never
+// collide.
+func runTOC(ctx context.Context, tc tocConfig, r2 r2Client) error {
+	doc, err := loadTOC(tc.tocPath)
+	if err != nil { return err }
+
+	downloadDir := filepath.Join(tc.outDir, "toc-downloads")
+	if err := os.MkdirAll(downloadDir, 0o755); err != nil { return err }
+
+	var matched, processed int
+	for rsIdx, rs := range doc.ReportingStructure {
+		plan, ok := matchesPlanFilters(rs, tc.planNameMatch, tc.planEIN)
+		if !ok { continue }
+		matched++
+		slug := planSlug(plan.PlanName)
+
+		for fileIdx, fr := range rs.InNetworkFiles {
+			if fr.Location == "" { continue }
+			localPath := filepath.Join(downloadDir, fmt.Sprintf("%s-%d-%d.json.gz", slug, rsIdx, fileIdx))
+			fmt.Printf("[toc] downloading plan=%q file=%d/%d %s\n", plan.PlanName, fileIdx+1, len(rs.InNetworkFiles), fr.Location)
+			if err := downloadRanged(fr.Location, localPath); err != nil {
+				return fmt.Errorf("downloading %s: %w", fr.Location, err)
+			}
+
+			ec := extractionConfig{
+				inPath:        localPath,
+				outDir:        filepath.Join(tc.outDir, slug, fmt.Sprintf("%d-%d", rsIdx, fileIdx)),
+				allowed:       tc.allowed,
+				usePigz:       tc.usePigz,
+				pigzThreads:   tc.pigzThreads,
+				progressEvery: tc.progressEvery,
+				prefix:        filepath.Join(tc.prefix, slug),
+				format:             tc.format,
+				parquetRowGroup:    tc.parquetRowGroup,
+				parquetCompression: tc.parquetCompression,
+				workers:            tc.workers,
+				noLocal:            tc.noLocal,
+				resume:             tc.resume,
+				checkpointEvery:    tc.checkpointEvery,
+				resumeOffset:       tc.resumeOffset,
+				gzindex:            tc.gzindex,
+			}
+			if _, err := extractOne(ctx, ec, r2); err != nil {
+				return fmt.Errorf("extracting %s (plan %q): %w", fr.Location, plan.PlanName, err)
+			}
+			processed++
+		}
+	}
+	fmt.Printf("[toc] matched %d reporting_structure entries, processed %d in_network files\n", matched, processed)
+	return nil
+}
+
+// downloadRanged fetches url into destPath using ranged GETs, resuming from
+// whatever partial bytes are already on disk. This lets a re-run after a
+// crash or spot eviction skip what it already pulled instead of starting a
+// multi-GB download over from byte 0. If destPath already holds the whole
+// file, the Range request lands past the end and the server answers 416;
+// that's treated as "already complete" rather than a fatal error, or a
+// single already-downloaded file would abort an entire -toc run.
+func downloadRanged(url, destPath string) error {
+	var startAt int64
+	if st, err := os.Stat(destPath); err == nil {
+		startAt = st.Size()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil { return err }
+	if startAt > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", startAt))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// server ignored our Range header (or we asked for the whole
+		// thing); start the file over rather than appending garbage.
+		flags |= os.O_TRUNC
+	case http.StatusRequestedRangeNotSatisfiable:
+		// startAt already at (or past) the server's full size -- a prior
+		// run already finished this download. That's success, not an
+		// error: asking again from byte 0 would just redownload it.
+		return nil
+	default:
+		return fmt.Errorf("GET %s: status %s", url, resp.Status)
+	}
+
+	f, err := os.OpenFile(destPath, flags, 0o644)
+	if err != nil { return err }
+	defer f.Close()
+
+	_, err = io.Copy(f, resp.Body)
+	return err
+}
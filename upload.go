@@ -0,0 +1,84 @@
+// upload.go
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	s3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	smithy "github.com/aws/smithy-go"
+)
+
+// retryableUploadCodes are S3-compatible error codes that a bare retry
+// usually clears. The default SDK retryer already treats most throttling as
+// retryable, but R2 leans on RequestTimeout/SlowDown heavily enough under
+// sustained multipart traffic that we call them out explicitly rather than
+// trust the default classifier to catch every shape we see in practice.
+var retryableUploadCodes = map[string]struct{}{
+	"RequestTimeout": {},
+	"SlowDown":       {},
+}
+
+// newUploadRetryer builds the retryer used for the R2 client: standard
+// exponential backoff with jitter, extended to always retry the error codes
+// in retryableUploadCodes on top of whatever the standard retryer already
+// classifies as retryable.
+func newUploadRetryer() aws.Retryer {
+	return retry.NewStandard(func(o *retry.StandardOptions) {
+		o.MaxAttempts = 8
+		o.Backoff = retry.NewExponentialJitterBackoff(30 * time.Second)
+		o.Retryables = append(o.Retryables, retry.IsErrorRetryableFunc(func(err error) aws.Ternary {
+			var ae smithy.APIError
+			if errors.As(err, &ae) {
+				if _, ok := retryableUploadCodes[ae.ErrorCode()]; ok {
+					return aws.TrueTernary
+				}
+			}
+			return aws.UnknownTernary
+		}))
+	})
+}
+
+// uploadPipe is an io.WriteCloser that streams straight into an S3 multipart
+// upload via r2Client.uploader, so a per-code file never needs to be
+// materialized on local disk first. Write feeds an io.Pipe; a background
+// goroutine drains the read side into Upload. Close blocks until that
+// upload finishes and returns its error, same as closing a local file would.
+type uploadPipe struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// newUploadPipe starts the background upload and returns the writer end.
+// ctx governs the Upload call, including every retry newUploadRetryer
+// schedules; cancelling it aborts the multipart upload in place. If Upload
+// fails (bad bucket/credentials, retries exhausted, ...), pr is closed with
+// that error so a writer blocked in pw.Write unblocks and sees it too,
+// instead of hanging forever with nothing left draining the pipe.
+func newUploadPipe(ctx context.Context, r2 r2Client, key, contentType string) *uploadPipe {
+	pr, pw := io.Pipe()
+	up := &uploadPipe{pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := r2.uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket:      &r2.bucket,
+			Key:         &key,
+			Body:        pr,
+			ContentType: aws.String(contentType),
+		})
+		pr.CloseWithError(err)
+		up.done <- err
+	}()
+	return up
+}
+
+func (u *uploadPipe) Write(p []byte) (int, error) { return u.pw.Write(p) }
+
+func (u *uploadPipe) Close() error {
+	if err := u.pw.Close(); err != nil { return err }
+	return <-u.done
+}
@@ -0,0 +1,415 @@
+// workers.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	gojson "github.com/goccy/go-json"
+)
+
+// shardFor deterministically assigns a billing code to one of n workers, so
+// every occurrence of a given (type, code) pair always lands on the same
+// worker and therefore the same writer map -- no code is ever written by two
+// workers. CPT 470 and MS-DRG 470 hash independently since key.join()
+// includes the type.
+func shardFor(key codeKey, n int) int {
+	if n <= 1 { return 0 }
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key.join()))
+	return int(h.Sum32() % uint32(n))
+}
+
+// rawItem is what the decoder goroutine hands to a worker: the item's raw
+// JSON plus the billing_code/type it already sniffed cheaply to decide
+// eligibility and shard assignment, so the worker never has to re-parse
+// those two fields. barrierAck, when non-nil, marks this as a checkpoint
+// barrier rather than a real item -- see checkpointBarrier.
+type rawItem struct {
+	raw        json.RawMessage
+	key        codeKey
+	barrierAck chan struct{}
+}
+
+// workerState is one shard's private writer map and unresolved-ref sink.
+// Because code ownership is disjoint by construction, no synchronization
+// is needed between workers. ctx/r2 are only consulted when ec.noLocal is
+// set, to stand up a streaming uploadPipe per code instead of a local file.
+// unresBW is the buffer sitting between unresW and unresF -- kept separately
+// for the same reason csvRowWriter keeps one: csv.Writer's own Flush doesn't
+// reach all the way through to unresF on its own.
+type workerState struct {
+	writers map[codeKey]rowWriter
+	unresW  *csv.Writer
+	unresBW *bufio.Writer
+	unresF  *os.File
+	summary extractionSummary
+	ctx     context.Context
+	r2      r2Client
+}
+
+// unresolvedRefHeader is the unresolved-refs CSV header, shared between
+// newWorkerState (which writes it) and unresolvedRefHeaderLine (which
+// fast_bcbs_extract.go uses to tell a genuinely empty unresolved file from
+// one that just has a header and no rows).
+var unresolvedRefHeader = []string{"billing_code_type", "billing_code", "ref_id"}
+
+// unresolvedRefHeaderLine is unresolvedRefHeader as it's actually written to
+// disk by csv.Writer (comma-joined, "\n"-terminated, no quoting needed since
+// none of these fields contain a comma/quote/newline) -- the exact byte
+// count of a header-only, zero-unresolved-rows file.
+var unresolvedRefHeaderLine = strings.Join(unresolvedRefHeader, ",") + "\n"
+
+func newWorkerState(id, total int, outDir string, ec extractionConfig, ctx context.Context, r2 r2Client) (*workerState, error) {
+	name := "unresolved_provider_references.csv"
+	if total > 1 {
+		name = fmt.Sprintf("unresolved_provider_references.worker%d.csv", id)
+	}
+	path := filepath.Join(outDir, name)
+
+	var f *os.File
+	var err error
+	writeHeader := true
+	if ec.resume && fileExists(path) {
+		if f, err = os.OpenFile(path, os.O_RDWR, 0o644); err == nil {
+			if err = truncateTrailingPartialLine(f); err == nil {
+				_, err = f.Seek(0, io.SeekEnd)
+			}
+		}
+		writeHeader = false
+	} else {
+		f, err = os.Create(path)
+	}
+	if err != nil { return nil, err }
+
+	bw := bufio.NewWriterSize(f, 1<<20)
+	w := csv.NewWriter(bw)
+	if writeHeader {
+		_ = w.Write(unresolvedRefHeader)
+	}
+	return &workerState{writers: map[codeKey]rowWriter{}, unresW: w, unresBW: bw, unresF: f, ctx: ctx, r2: r2}, nil
+}
+
+// flush pushes every writer's buffered rows (and the unresolved-refs sink)
+// out to their underlying files/pipes without closing anything, so a
+// checkpoint taken right after every worker's flush covers only durably
+// written data -- see checkpointBarrier.
+func (ws *workerState) flush() error {
+	for _, w := range ws.writers {
+		if err := w.Flush(); err != nil { return err }
+	}
+	ws.unresW.Flush()
+	if err := ws.unresW.Error(); err != nil { return err }
+	return ws.unresBW.Flush()
+}
+
+// fileExists is a plain os.Stat check, used by both -resume (does this
+// code's file already exist to append to?) and getWriter.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (ws *workerState) getWriter(csvDir string, key codeKey, ec extractionConfig) rowWriter {
+	if w, ok := ws.writers[key]; ok { return w }
+	stem := fmt.Sprintf("in_network_%s_%s", key.Type, key.Code)
+	var w rowWriter
+	var err error
+	if ec.noLocal {
+		uploadKey := filepath.ToSlash(filepath.Join(ec.prefix, stem+outputExt(ec.format)))
+		fmt.Println("Uploading (streaming):", "s3://"+ws.r2.bucket+"/"+uploadKey)
+		w, err = newCSVRowWriterTo(newUploadPipe(ws.ctx, ws.r2, uploadKey, outputContentType(ec.format)))
+	} else {
+		path := filepath.Join(csvDir, stem+outputExt(ec.format))
+		switch {
+		case ec.format == "parquet":
+			w, err = newParquetRowWriter(path, ec.parquetCompression, ec.parquetRowGroup)
+		case ec.resume && fileExists(path):
+			if size, ok := ec.resumeWriterSizes[stem+outputExt(ec.format)]; ok {
+				w, err = newCSVRowWriterAppend(path, size)
+			} else {
+				// No checkpointed size for this file -- it didn't exist yet
+				// at the last durable barrier, so nothing in it is
+				// confirmed written; start it over rather than appending to
+				// bytes that are about to be duplicated anyway.
+				w, err = newCSVRowWriter(path)
+			}
+		default:
+			w, err = newCSVRowWriter(path)
+		}
+	}
+	if err != nil { panic(err) }
+	ws.writers[key] = w
+	return w
+}
+
+// processItem is the per-rate/provider-group expansion that used to live
+// directly in extractOne's hot loop, now scoped to a single worker's own
+// writers and unresolved-ref sink.
+func (ws *workerState) processItem(ec extractionConfig, refIndex map[string][]ProviderGroup, csvDir string, it *Item, key codeKey) error {
+	na := anyToString(it.NegotiationArrangement)
+	for _, rate := range it.NegotiatedRates {
+		groups := rate.ProviderGroups
+		if len(rate.ProviderReferences) > 0 {
+			ws.summary.SkippedRefRates++
+			for _, refID := range rate.ProviderReferences {
+				refKey := strconv.FormatInt(refID, 10)
+				resolved, ok := refIndex[refKey]
+				if !ok {
+					_ = ws.unresW.Write([]string{key.Type, key.Code, refKey})
+					ws.summary.SkippedRefIDs++
+					continue
+				}
+				groups = append(groups, resolved...)
+			}
+		}
+		if len(groups) == 0 || len(rate.NegotiatedPrices) == 0 { continue }
+
+		w := ws.getWriter(csvDir, key, ec)
+		for _, pg := range groups {
+			tinType, tinVal := "", ""
+			if pg.TIN != nil { tinType = pg.TIN.Type; tinVal = pg.TIN.Value }
+			npis := normalizeNPIs(pg.NPI)
+			if len(npis) == 0 { continue }
+
+			for _, p := range rate.NegotiatedPrices {
+				scodes := joinOrEmpty(p.ServiceCode)
+				mods := joinOrEmpty(p.BillingCodeModifier)
+				rateStr := anyToString(p.NegotiatedRate)
+				for _, npi := range npis {
+					if err := w.Write(outputRow{
+						NPI: npi, TinType: tinType, TinValue: tinVal,
+						NegotiatedRate: rateStr, ExpirationDate: p.ExpirationDate, ServiceCode: scodes,
+						BillingCode: key.Code, BillingCodeType: key.Type, NegotiationArrangement: na,
+						NegotiatedType: p.NegotiatedType, BillingClass: p.BillingClass, BillingCodeModifier: mods,
+					}); err != nil {
+						return err
+					}
+					ws.summary.OutRows++
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (ws *workerState) close() (unresPath string, err error) {
+	for _, w := range ws.writers {
+		if e := w.Close(); e != nil && err == nil { err = e }
+	}
+	ws.unresW.Flush()
+	if e := ws.unresW.Error(); e != nil && err == nil { err = e }
+	if e := ws.unresBW.Flush(); e != nil && err == nil { err = e }
+	unresPath = ws.unresF.Name()
+	if e := ws.unresF.Close(); e != nil && err == nil { err = e }
+	return unresPath, err
+}
+
+// runExtraction streams in_network, cheaply sniffs each item's billing
+// code, filters against the allowlist, and routes the raw JSON to the
+// worker that owns that code's shard. The decoder goroutine (this one)
+// never decodes a full Item -- that's the worker's job, using goccy/go-json
+// for lower per-item allocation than encoding/json. It returns once every
+// worker has drained its channel. Under ec.noLocal each worker's per-code
+// writers have already streamed straight to R2 via ctx/r2; otherwise
+// extractOne uploads the per-code files it finds under csvDir. The returned
+// paths are only the unresolved-refs files, one per worker.
+//
+// Under ec.resume, a checkpoint from a prior run is loaded and every item
+// with index < checkpoint.ItemIndex is decoded and discarded instead of
+// routed to a worker -- gzip isn't seekable, so this is the only way to
+// "skip forward". getWriter (via ec.resume) reopens each code's existing
+// CSV in append mode so those already-written rows aren't duplicated. Every
+// checkpoint write is preceded by checkpointBarrier, so ItemIndex only ever
+// advances to a point every worker has durably flushed -- never to the
+// decoder's read cursor, which can run ahead of what's actually on disk by
+// as much as a channel's worth of buffered items.
+func runExtraction(ctx context.Context, ec extractionConfig, r2 r2Client, refIndex map[string][]ProviderGroup, csvDir, outDir string) (*extractionSummary, []string, error) {
+	n := ec.workers
+	if n < 1 { n = 1 }
+
+	// Hashed once up front (not per checkpoint write -- this file can be tens
+	// of GB) whenever anything needs to compare against or record it.
+	var inputHash string
+	var err error
+	if ec.resume || ec.checkpointEvery > 0 {
+		if inputHash, err = sha256File(ec.inPath); err != nil { return nil, nil, err }
+	}
+
+	// Loaded (and, via ec.resumeWriterSizes, applied) before any worker
+	// goroutine starts: ec is captured by those goroutines' closures, so
+	// mutating it after they're spawned would be a data race.
+	var startIndex int64
+	if ec.resume {
+		ckpt, err := loadCheckpoint(outDir)
+		if err != nil { return nil, nil, err }
+		if ckpt != nil {
+			if ckpt.InputSHA256 != inputHash {
+				return nil, nil, fmt.Errorf("checkpoint in %s was written for a different -input; refusing to resume", outDir)
+			}
+			startIndex = ckpt.ItemIndex
+			ec.resumeWriterSizes = ckpt.WriterSizes
+			fmt.Printf("[resume] %s: skipping forward to item %d\n", ec.prefix, startIndex)
+		}
+	}
+
+	states := make([]*workerState, n)
+	for i := range states {
+		ws, err := newWorkerState(i, n, outDir, ec, ctx, r2)
+		if err != nil { return nil, nil, err }
+		states[i] = ws
+	}
+
+	chans := make([]chan rawItem, n)
+	for i := range chans { chans[i] = make(chan rawItem, 256) }
+
+	errCh := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ws := states[i]
+			for ri := range chans[i] {
+				if ri.barrierAck != nil {
+					if err := ws.flush(); err != nil {
+						errCh <- fmt.Errorf("worker %d: checkpoint flush: %w", i, err)
+						return
+					}
+					close(ri.barrierAck)
+					continue
+				}
+				var it Item
+				if err := gojson.Unmarshal(ri.raw, &it); err != nil {
+					errCh <- fmt.Errorf("worker %d: decoding item: %w", i, err)
+					return
+				}
+				if err := ws.processItem(ec, refIndex, csvDir, &it, ri.key); err != nil {
+					errCh <- fmt.Errorf("worker %d: %w", i, err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	abort := func(err error) (*extractionSummary, []string, error) {
+		for _, ch := range chans { close(ch) }
+		wg.Wait()
+		return nil, nil, err
+	}
+
+	// checkpointBarrier sends every worker a flush-and-ack marker and waits
+	// for all of them, guaranteeing (channels are FIFO) that every item
+	// enqueued before the barrier has been decoded, written, and flushed to
+	// its underlying file/pipe by the time this returns -- not just decoded
+	// and handed off to a channel buffer that a crash could still lose. Only
+	// after that is it safe to checkpoint the decoder's current position.
+	checkpointBarrier := func() error {
+		acks := make([]chan struct{}, n)
+		for i, ch := range chans {
+			ack := make(chan struct{})
+			acks[i] = ack
+			select {
+			case ch <- rawItem{barrierAck: ack}:
+			case err := <-errCh:
+				return err
+			}
+		}
+		for _, ack := range acks {
+			select {
+			case <-ack:
+			case err := <-errCh:
+				return err
+			}
+		}
+		return nil
+	}
+
+	dec, closeInput, err := openInNetworkStream(ec)
+	if err != nil { return abort(err) }
+	defer closeInput()
+
+	// rowsByCode is a best-effort per-code counter of items routed to a
+	// worker so far, snapshotted into the checkpoint's RowsPerCode -- it's a
+	// diagnostic, not the resume mechanism itself, so it doesn't need to be
+	// exactly in step with what the workers have actually written yet.
+	rowsByCode := &sync.Map{}
+
+	var seenItems, keptItems int64
+	var envelope struct {
+		BillingCodeType string `json:"billing_code_type"`
+		BillingCode     string `json:"billing_code"`
+	}
+	for dec.More() {
+		// Checked before decoding the next item, so every item seen counts
+		// toward -checkpoint-every (kept or filtered out), and dec.InputOffset()
+		// still sits just past the last item included in seenItems.
+		if ec.checkpointEvery > 0 && seenItems > startIndex && seenItems%int64(ec.checkpointEvery) == 0 {
+			if err := checkpointBarrier(); err != nil { return abort(err) }
+			if err := writeCheckpoint(ec, outDir, csvDir, inputHash, seenItems, dec.InputOffset(), rowsByCode); err != nil {
+				fmt.Fprintf(os.Stderr, "[checkpoint] %s: %v\n", ec.prefix, err)
+			}
+		}
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil { return abort(err) }
+		idx := seenItems
+		seenItems++
+
+		if idx < startIndex {
+			continue // already processed in a prior run
+		}
+
+		envelope.BillingCodeType, envelope.BillingCode = "", ""
+		if err := json.Unmarshal(raw, &envelope); err != nil { return abort(err) }
+
+		bc := strings.TrimSpace(envelope.BillingCode)
+		if bc == "" { continue }
+		key := codeKey{Type: normalizeCodeType(envelope.BillingCodeType), Code: bc}
+		if _, ok := ec.allowed[key]; !ok { continue }
+		keptItems++
+
+		select {
+		case chans[shardFor(key, n)] <- rawItem{raw: raw, key: key}:
+			counter, _ := rowsByCode.LoadOrStore(key.join(), new(int64))
+			atomic.AddInt64(counter.(*int64), 1)
+		case err := <-errCh:
+			return abort(err)
+		}
+
+		if ec.progressEvery > 0 && keptItems%int64(ec.progressEvery) == 0 {
+			fmt.Printf("[progress] %s items: %d\n", ec.prefix, keptItems)
+		}
+	}
+	expectDelim(dec, ']')
+
+	for _, ch := range chans { close(ch) }
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		if err != nil { return nil, nil, err }
+	}
+
+	summary := &extractionSummary{SeenItems: seenItems, KeptItems: keptItems}
+	var unresPaths []string
+	for _, ws := range states {
+		p, err := ws.close()
+		if err != nil { return nil, nil, err }
+		unresPaths = append(unresPaths, p)
+		summary.OutRows += ws.summary.OutRows
+		summary.SkippedRefRates += ws.summary.SkippedRefRates
+		summary.SkippedRefIDs += ws.summary.SkippedRefIDs
+	}
+	return summary, unresPaths, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// synthMRF writes a minimal-but-representative in_network-rates.json.gz
+// with itemCount CPT items, each carrying one provider group (two NPIs) and
+// one price, so BenchmarkExtraction can measure the hot loop without needing
+// a real multi-GB payer file on disk.
+func synthMRF(t testing.TB, path string, itemCount int) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil { t.Fatal(err) }
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	defer gw.Close()
+
+	fmt.Fprint(gw, `{"in_network":[`)
+	for i := 0; i < itemCount; i++ {
+		if i > 0 { fmt.Fprint(gw, ",") }
+		it := Item{
+			BillingCodeType:        "CPT",
+			BillingCode:            fmt.Sprintf("%05d", 10000+i%25),
+			NegotiationArrangement: "ffs",
+			NegotiatedRates: []Rate{{
+				ProviderGroups: []ProviderGroup{{NPI: []any{"1111111111", "2222222222"}}},
+				NegotiatedPrices: []Price{{
+					NegotiatedRate: 123.45,
+					ExpirationDate: "2026-12-31",
+					ServiceCode:    []string{"11", "22"},
+					NegotiatedType: "negotiated",
+					BillingClass:   "professional",
+				}},
+			}},
+		}
+		b, err := json.Marshal(it)
+		if err != nil { t.Fatal(err) }
+		gw.Write(b)
+	}
+	fmt.Fprint(gw, `]}`)
+}
+
+// BenchmarkExtraction reports rows/sec and peak RSS for a range of
+// -workers settings against the same synthetic input, so tuning -workers
+// alongside -pigz-threads has real numbers to look at instead of guesses.
+func BenchmarkExtraction(b *testing.B) {
+	dir := b.TempDir()
+	inPath := filepath.Join(dir, "synthetic.json.gz")
+	synthMRF(b, inPath, 25000)
+
+	allowed := map[codeKey]struct{}{}
+	for i := 0; i < 25; i++ { allowed[codeKey{Type: "CPT", Code: fmt.Sprintf("%05d", 10000+i)}] = struct{}{} }
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		workers := workers
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			var memBefore, memAfter runtime.MemStats
+			runtime.ReadMemStats(&memBefore)
+			b.ResetTimer()
+
+			var totalRows int64
+			for i := 0; i < b.N; i++ {
+				outDir := b.TempDir()
+				ec := extractionConfig{
+					inPath:  inPath,
+					outDir:  outDir,
+					allowed: allowed,
+					workers: workers,
+					format:  "csv",
+				}
+				csvDir := filepath.Join(outDir, "csv")
+				if err := os.MkdirAll(csvDir, 0o755); err != nil { b.Fatal(err) }
+				summary, _, err := runExtraction(context.Background(), ec, r2Client{}, map[string][]ProviderGroup{}, csvDir, outDir)
+				if err != nil { b.Fatal(err) }
+				totalRows += summary.OutRows
+			}
+
+			b.StopTimer()
+			runtime.ReadMemStats(&memAfter)
+			elapsed := b.Elapsed().Seconds()
+			if elapsed > 0 {
+				b.ReportMetric(float64(totalRows)/elapsed, "rows/sec")
+			}
+			b.ReportMetric(float64(memAfter.Sys)/(1<<20), "peak_rss_MB")
+		})
+	}
+}
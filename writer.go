@@ -0,0 +1,160 @@
+// writer.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"io"
+	"os"
+	"strings"
+)
+
+// outputRow is one NPI/TIN/price row, in the form every rowWriter
+// implementation receives it in: every field is already a string.
+// csvRowWriter writes them as-is; parquetRowWriter parses negotiated_rate
+// and expiration_date into typed columns.
+type outputRow struct {
+	NPI                    string
+	TinType                string
+	TinValue               string
+	NegotiatedRate         string // already stringified by anyToString; csvRowWriter uses as-is, parquetRowWriter reparses to float64
+	ExpirationDate         string // "YYYY-MM-DD"
+	ServiceCode            string
+	BillingCode            string
+	BillingCodeType        string
+	NegotiationArrangement string
+	NegotiatedType         string
+	BillingClass           string
+	BillingCodeModifier    string
+}
+
+// rowWriter is the per-code output sink. getWriter (in workers.go)
+// picks an implementation based on -format; the hot loop only ever talks
+// to this interface so it doesn't care which one it got. Flush pushes
+// buffered rows out to the underlying file/pipe without closing it, so a
+// checkpoint taken right after a Flush covers data that's actually durable,
+// not still sitting in an in-process buffer.
+type rowWriter interface {
+	Write(row outputRow) error
+	Flush() error
+	Close() error
+}
+
+var outputColumns = []string{
+	"npi", "tin_type", "tin_value",
+	"negotiated_rate", "expiration_date", "service_code",
+	"billing_code", "billing_code_type", "negotiation_arrangement",
+	"negotiated_type", "billing_class", "billing_code_modifier",
+}
+
+// csvRowWriter is the original writerPack behavior, just behind rowWriter.
+// wc is whatever sink getWriter picked for this code: a local *os.File when
+// writing to -out/csv, or an uploadPipe streaming straight to R2 under
+// -no-local. bw is the 1 MiB buffer sitting between csv.Writer and wc --
+// csv.NewWriter always wraps whatever io.Writer it's given in its own
+// (smaller) internal bufio.Writer, so bw has to be kept and flushed
+// separately or bytes csv.Writer.Flush "flushes" just end up parked in bw
+// with nothing left to push them on to wc.
+type csvRowWriter struct {
+	wc io.WriteCloser
+	bw *bufio.Writer
+	w  *csv.Writer
+}
+
+func newCSVRowWriter(path string) (*csvRowWriter, error) {
+	f, err := os.Create(path)
+	if err != nil { return nil, err }
+	return newCSVRowWriterTo(f)
+}
+
+func newCSVRowWriterTo(wc io.WriteCloser) (*csvRowWriter, error) {
+	bw := bufio.NewWriterSize(wc, 1<<20)
+	w := csv.NewWriter(bw)
+	if err := w.Write(outputColumns); err != nil { wc.Close(); return nil, err }
+	return &csvRowWriter{wc: wc, bw: bw, w: w}, nil
+}
+
+func (c *csvRowWriter) Write(row outputRow) error {
+	return c.w.Write([]string{
+		row.NPI, row.TinType, row.TinValue,
+		row.NegotiatedRate, row.ExpirationDate, row.ServiceCode,
+		row.BillingCode, row.BillingCodeType, row.NegotiationArrangement,
+		row.NegotiatedType, row.BillingClass, row.BillingCodeModifier,
+	})
+}
+
+// Flush pushes every buffered row through both buffering layers (csv.Writer,
+// then bw) out to wc, without closing wc.
+func (c *csvRowWriter) Flush() error {
+	c.w.Flush()
+	if err := c.w.Error(); err != nil { return err }
+	return c.bw.Flush()
+}
+
+func (c *csvRowWriter) Close() error {
+	if err := c.Flush(); err != nil { c.wc.Close(); return err }
+	return c.wc.Close()
+}
+
+// newCSVRowWriterAppend reopens an existing per-code CSV for -resume. It
+// trusts the file already has its header, so it skips outputColumns, but it
+// first truncates back to checkpointSize -- this file's exact size as of
+// the last checkpoint barrier (checkpointFile.WriterSizes) -- before
+// repairing a trailing partial row and appending. Rows written after that
+// barrier are about to be replayed (their items are >= the checkpointed
+// ItemIndex), so anything past checkpointSize would otherwise end up
+// duplicated; truncateTrailingPartialLine alone only repairs a half-written
+// last line, it doesn't know about whole extra rows.
+func newCSVRowWriterAppend(path string, checkpointSize int64) (*csvRowWriter, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil { return nil, err }
+	if st, err := f.Stat(); err == nil && st.Size() > checkpointSize {
+		if err := f.Truncate(checkpointSize); err != nil { f.Close(); return nil, err }
+	}
+	if err := truncateTrailingPartialLine(f); err != nil { f.Close(); return nil, err }
+	if _, err := f.Seek(0, io.SeekEnd); err != nil { f.Close(); return nil, err }
+	bw := bufio.NewWriterSize(f, 1<<20)
+	return &csvRowWriter{wc: f, bw: bw, w: csv.NewWriter(bw)}, nil
+}
+
+// truncateTrailingPartialLine drops any bytes in f after the last '\n', so a
+// row left half-written by a crash isn't mistaken for a complete one or
+// silently glued onto the next Write.
+func truncateTrailingPartialLine(f *os.File) error {
+	st, err := f.Stat()
+	if err != nil { return err }
+	size := st.Size()
+	if size == 0 { return nil }
+
+	const chunk = 4096
+	buf := make([]byte, chunk)
+	for pos := size; pos > 0; {
+		n := int64(chunk)
+		if pos < n { n = pos }
+		pos -= n
+		if _, err := f.ReadAt(buf[:n], pos); err != nil { return err }
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			return f.Truncate(pos + int64(i) + 1)
+		}
+	}
+	// no newline anywhere -- the whole file is one partial line, which should
+	// only happen if a crash landed before the header even finished writing.
+	return f.Truncate(0)
+}
+
+func outputExt(format string) string {
+	if format == "parquet" { return ".parquet" }
+	return ".csv"
+}
+
+func outputContentType(format string) string {
+	if format == "parquet" { return "application/vnd.apache.parquet" }
+	return "text/csv"
+}
+
+func nilIfNil(s []string) []string { if s == nil { return []string{} }; return s }
+
+func joinOrEmpty(parts []string) string {
+	return strings.Join(nilIfNil(parts), "|")
+}